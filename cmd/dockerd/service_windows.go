@@ -2,15 +2,21 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
+	"unicode/utf16"
+	"unsafe"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/opts"
 	flag "github.com/docker/docker/pkg/mflag"
 	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
@@ -25,13 +31,99 @@ var (
 	flUnregisterService = flag.Bool([]string{"-unregister-service"}, false, "Unregister the service and exit")
 	flRunService        = flag.Bool([]string{"-run-service"}, false, "")
 
+	flLogFile         = flag.String([]string{"-log-file"}, "", "Write daemon logs to this file instead of relying solely on the Windows Event Log")
+	flLogFileMaxSize  = flag.Int64([]string{"-log-file-max-size"}, 20*1024*1024, "Maximum size in bytes of the log file before it is rotated")
+	flLogFileMaxFiles = flag.Int([]string{"-log-file-max-files"}, 5, "Maximum number of rotated log files to retain")
+
+	flReconfigureService     = flag.Bool([]string{"-reconfigure-service"}, false, "Reconfigure recovery and startup settings of an already-registered service and exit")
+	flServiceRestartDelay    = flag.Duration([]string{"-service-restart-delay"}, 60*time.Second, "Delay before the SCM restarts the service after a crash")
+	flServiceRestartAttempts = flag.Int([]string{"-service-restart-attempts"}, 2, "Number of consecutive crashes that trigger an automatic restart before the SCM gives up")
+	flServiceResetPeriod     = flag.Duration([]string{"-service-reset-period"}, 24*time.Hour, "How long the service must run without crashing before the failure count is reset")
+	flServiceDelayedStart    = flag.Bool([]string{"-service-delayed-start"}, false, "Start the service a short time after boot, once other automatic services have settled")
+
+	flServiceDependsOn = opts.NewListOpts(nil)
+	flServiceAccount   = flag.String([]string{"-service-account"}, "", "Run the service as this account (e.g. a gMSA) instead of LocalSystem")
+	flServicePassword  = flag.String([]string{"-service-password"}, "", "Password for --service-account")
+
+	flServicePreshutdownTimeout = flag.Duration([]string{"-service-preshutdown-timeout"}, 3*time.Minute, "How long the SCM should wait for containers to drain before killing the service on preshutdown")
+
 	setStdHandle = syscall.NewLazyDLL("kernel32.dll").NewProc("SetStdHandle")
 	oldStderr    syscall.Handle
 	panicFile    *os.File
 
 	service *handler
+
+	advapi32                 = syscall.NewLazyDLL("advapi32.dll")
+	procQueryServiceStatusEx = advapi32.NewProc("QueryServiceStatusEx")
+	procChangeServiceConfig2 = advapi32.NewProc("ChangeServiceConfig2W")
+)
+
+// serviceDescriptionText is installed via SERVICE_CONFIG_DESCRIPTION so that
+// tools like sc.exe qc show something more useful than the bare DisplayName.
+const serviceDescriptionText = "Manages and runs Docker containers."
+
+// Information levels accepted by ChangeServiceConfig2, and the SC_ACTION
+// types used to build the failure-actions array. These mirror the values in
+// winsvc.h; golang.org/x/sys/windows/svc/mgr doesn't expose them.
+const (
+	serviceConfigDescription          = 1
+	serviceConfigFailureActions       = 2
+	serviceConfigDelayedAutoStartInfo = 3
+	serviceConfigPreshutdownInfo      = 7
+
+	scActionNone    = 0
+	scActionRestart = 1
+)
+
+type scAction struct {
+	Type  uint32
+	Delay uint32
+}
+
+type serviceFailureActions struct {
+	ResetPeriod  uint32
+	RebootMsg    *uint16
+	Command      *uint16
+	ActionsCount uint32
+	Actions      *scAction
+}
+
+type serviceDelayedAutoStartInfo struct {
+	IsDelayedAutoStartUp uint32
+}
+
+type serviceDescription struct {
+	Description *uint16
+}
+
+type servicePreshutdownInfo struct {
+	PreshutdownTimeout uint32
+}
+
+// wellKnownServiceDependencies are services that aren't necessarily declared
+// as SCM dependencies of Docker, but that commonly cause "Docker won't
+// start" reports on Windows container hosts when they aren't healthy.
+var wellKnownServiceDependencies = []string{"hns", "vmcompute", "com.docker.service"}
+
+const (
+	maxDependencyDepth = 8
+	maxDependencyNodes = 256
 )
 
+const (
+	// preshutdownCheckpointInterval is how often Execute pushes a fresh
+	// CheckPoint to the SCM while draining on SERVICE_CONTROL_PRESHUTDOWN.
+	preshutdownCheckpointInterval = 10 * time.Second
+	// preshutdownWaitHintMillis tells the SCM how long to wait after each
+	// CheckPoint before considering the service hung; it must comfortably
+	// exceed preshutdownCheckpointInterval.
+	preshutdownWaitHintMillis = uint32(preshutdownCheckpointInterval / time.Millisecond * 2)
+)
+
+func init() {
+	flag.Var(&flServiceDependsOn, []string{"-service-depends-on"}, "Declare a service this one depends on (may be repeated)")
+}
+
 const (
 	// These should match the values in event_messages.mc.
 	eventInfo  = 1
@@ -51,9 +143,22 @@ type handler struct {
 
 type etwHook struct {
 	log *eventlog.Log
+
+	// onlyHighSeverity restricts this hook to Warn/Error/Fatal/Panic. It is
+	// set when a --log-file is in use, so the Event Log is reserved for
+	// critical events and verbose output goes to the file instead.
+	onlyHighSeverity bool
 }
 
 func (h *etwHook) Levels() []logrus.Level {
+	if h.onlyHighSeverity {
+		return []logrus.Level{
+			logrus.PanicLevel,
+			logrus.FatalLevel,
+			logrus.ErrorLevel,
+			logrus.WarnLevel,
+		}
+	}
 	return []logrus.Level{
 		logrus.PanicLevel,
 		logrus.FatalLevel,
@@ -136,6 +241,281 @@ func (h *etwHook) Fire(e *logrus.Entry) error {
 	return windows.ReportEvent(h.log.Handle, etype, 0, eid, 0, count, 0, &ss[0], nil)
 }
 
+// rotatingFileHook is a logrus hook that writes formatted log entries to a
+// file, rotating it by renaming to numbered siblings (path.1, path.2, ...)
+// once it grows past maxSize. It is used to back --log-file.
+type rotatingFileHook struct {
+	mu        sync.Mutex
+	path      string
+	maxSize   int64
+	maxFiles  int
+	formatter logrus.Formatter
+
+	f    *os.File
+	size int64
+}
+
+func newRotatingFileHook(path string, maxSize int64, maxFiles int) (*rotatingFileHook, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &rotatingFileHook{
+		path:      path,
+		maxSize:   maxSize,
+		maxFiles:  maxFiles,
+		formatter: &logrus.TextFormatter{DisableColors: true, FullTimestamp: true},
+		f:         f,
+		size:      st.Size(),
+	}, nil
+}
+
+func (h *rotatingFileHook) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+		logrus.InfoLevel,
+		logrus.DebugLevel,
+	}
+}
+
+func (h *rotatingFileHook) Fire(e *logrus.Entry) error {
+	b, err := h.formatter.Format(e)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.maxSize > 0 && h.size+int64(len(b)) > h.maxSize {
+		if err := h.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := h.f.Write(b)
+	h.size += int64(n)
+	return err
+}
+
+// rotate closes the current log file, shifts path.1..path.maxFiles down by
+// one (dropping the oldest), renames path to path.1, and reopens path fresh.
+func (h *rotatingFileHook) rotate() error {
+	h.f.Close()
+
+	if h.maxFiles > 0 {
+		oldest := fmt.Sprintf("%s.%d", h.path, h.maxFiles)
+		os.Remove(oldest)
+		for n := h.maxFiles; n > 1; n-- {
+			os.Rename(fmt.Sprintf("%s.%d", h.path, n-1), fmt.Sprintf("%s.%d", h.path, n))
+		}
+		os.Rename(h.path, fmt.Sprintf("%s.1", h.path))
+	}
+
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	h.f = f
+	h.size = 0
+	return nil
+}
+
+// serviceStatusProcess mirrors the Win32 SERVICE_STATUS_PROCESS struct
+// returned by QueryServiceStatusEx with the SC_STATUS_PROCESS_INFO
+// information level.
+type serviceStatusProcess struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+	ProcessID               uint32
+	ServiceFlags            uint32
+}
+
+func queryServiceStatusProcess(h windows.Handle) (*serviceStatusProcess, error) {
+	const scStatusProcessInfo = 0
+
+	var (
+		status serviceStatusProcess
+		needed uint32
+	)
+
+	r, _, err := procQueryServiceStatusEx.Call(
+		uintptr(h),
+		uintptr(scStatusProcessInfo),
+		uintptr(unsafe.Pointer(&status)),
+		unsafe.Sizeof(status),
+		uintptr(unsafe.Pointer(&needed)),
+	)
+	if r == 0 {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func serviceStateString(state svc.State) string {
+	switch state {
+	case svc.Stopped:
+		return "Stopped"
+	case svc.StartPending:
+		return "StartPending"
+	case svc.StopPending:
+		return "StopPending"
+	case svc.Running:
+		return "Running"
+	case svc.ContinuePending:
+		return "ContinuePending"
+	case svc.PausePending:
+		return "PausePending"
+	case svc.Paused:
+		return "Paused"
+	default:
+		return fmt.Sprintf("Unknown(%d)", state)
+	}
+}
+
+func serviceStartTypeString(startType uint32) string {
+	switch startType {
+	case mgr.StartManual:
+		return "Manual"
+	case mgr.StartAutomatic:
+		return "Automatic"
+	case mgr.StartDisabled:
+		return "Disabled"
+	default:
+		return fmt.Sprintf("Unknown(%d)", startType)
+	}
+}
+
+// serviceDependencyNode is one node in a JSON dump of the SCM dependency
+// graph rooted at the Docker service, used to diagnose startup failures.
+type serviceDependencyNode struct {
+	Name                    string                   `json:"Name"`
+	DisplayName             string                   `json:"DisplayName,omitempty"`
+	State                   string                   `json:"State,omitempty"`
+	StartType               string                   `json:"StartType,omitempty"`
+	ExitCode                uint32                   `json:"ExitCode,omitempty"`
+	ServiceSpecificExitCode uint32                   `json:"ServiceSpecificExitCode,omitempty"`
+	BinaryPathName          string                   `json:"BinaryPathName,omitempty"`
+	Dependencies            []*serviceDependencyNode `json:"Dependencies,omitempty"`
+	Error                   string                   `json:"Error,omitempty"`
+}
+
+// resolveServiceDependencyNode recursively resolves the DependOnService
+// chain for name into a tree of serviceDependencyNodes. visited and nodes
+// are shared across the whole walk to detect cycles and cap the graph size.
+func resolveServiceDependencyNode(m *mgr.Mgr, name string, depth int, visited map[string]bool, nodes *int) *serviceDependencyNode {
+	node := &serviceDependencyNode{Name: name}
+
+	if visited[name] {
+		node.Error = "already visited (dependency cycle or shared dependency)"
+		return node
+	}
+	visited[name] = true
+
+	if *nodes >= maxDependencyNodes {
+		node.Error = "dependency graph node cap reached"
+		return node
+	}
+	*nodes++
+
+	s, err := m.OpenService(name)
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	defer s.Close()
+
+	cfg, err := s.Config()
+	if err != nil {
+		node.Error = err.Error()
+		return node
+	}
+	node.DisplayName = cfg.DisplayName
+	node.StartType = serviceStartTypeString(cfg.StartType)
+	node.BinaryPathName = cfg.BinaryPathName
+
+	if status, err := queryServiceStatusProcess(windows.Handle(s.Handle)); err == nil {
+		node.State = serviceStateString(svc.State(status.CurrentState))
+		node.ExitCode = status.Win32ExitCode
+		node.ServiceSpecificExitCode = status.ServiceSpecificExitCode
+	} else {
+		node.Error = err.Error()
+	}
+
+	if depth >= maxDependencyDepth {
+		return node
+	}
+	for _, dep := range cfg.Dependencies {
+		node.Dependencies = append(node.Dependencies, resolveServiceDependencyNode(m, dep, depth+1, visited, nodes))
+	}
+
+	return node
+}
+
+// dumpServiceDependencyDiagnostics walks the SCM dependency graph rooted at
+// serviceName, plus any well-known prerequisites not already covered by it,
+// so an operator diagnosing "Docker won't start" can see the state of the
+// whole chain at a glance.
+func dumpServiceDependencyDiagnostics(serviceName string) *serviceDependencyNode {
+	m, err := mgr.Connect()
+	if err != nil {
+		return &serviceDependencyNode{Name: serviceName, Error: err.Error()}
+	}
+	defer m.Disconnect()
+
+	nodes := 0
+	visited := map[string]bool{}
+	root := resolveServiceDependencyNode(m, serviceName, 0, visited, &nodes)
+
+	for _, extra := range wellKnownServiceDependencies {
+		if visited[extra] {
+			continue
+		}
+		root.Dependencies = append(root.Dependencies, resolveServiceDependencyNode(m, extra, 1, visited, &nodes))
+	}
+
+	return root
+}
+
+// logServiceDependencyDiagnostics serializes the SCM dependency graph for
+// serviceName and logs it at Error level, so it reaches the Event Log (and
+// --log-file, if set) via the installed logrus hooks. If the panic file has
+// already been opened, the dump is also written directly to it, since it
+// survives even when the Event Log/--log-file setup itself is what's broken,
+// and logrus's hooks never write there; when svc.Run fails before the
+// service has started, no panic file is open yet and only the hooks get it.
+func logServiceDependencyDiagnostics(serviceName string) {
+	root := dumpServiceDependencyDiagnostics(serviceName)
+
+	b, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		logrus.Errorf("failed to marshal service dependency diagnostics: %v", err)
+		return
+	}
+
+	logrus.Errorf("service dependency diagnostics for %q:\n%s", serviceName, b)
+
+	if panicFile != nil {
+		fmt.Fprintf(panicFile, "service dependency diagnostics for %q:\n%s\n", serviceName, b)
+	}
+}
+
 func getServicePath() (string, error) {
 	p, err := exec.LookPath(os.Args[0])
 	if err != nil {
@@ -144,21 +524,283 @@ func getServicePath() (string, error) {
 	return filepath.Abs(p)
 }
 
+// configureServiceFailureActions sets the SCM auto-recovery actions for s:
+// --service-restart-attempts restarts spaced --service-restart-delay apart,
+// followed by a final no-op action, with the failure count reset after
+// --service-reset-period of healthy uptime.
+func configureServiceFailureActions(s *mgr.Service) error {
+	actions := make([]scAction, 0, *flServiceRestartAttempts+1)
+	for i := 0; i < *flServiceRestartAttempts; i++ {
+		actions = append(actions, scAction{Type: scActionRestart, Delay: uint32(flServiceRestartDelay.Nanoseconds() / int64(time.Millisecond))})
+	}
+	actions = append(actions, scAction{Type: scActionNone})
+
+	cfg := serviceFailureActions{
+		ResetPeriod:  uint32(flServiceResetPeriod.Seconds()),
+		ActionsCount: uint32(len(actions)),
+		Actions:      &actions[0],
+	}
+
+	r, _, err := procChangeServiceConfig2.Call(
+		uintptr(s.Handle),
+		uintptr(serviceConfigFailureActions),
+		uintptr(unsafe.Pointer(&cfg)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// configureServiceDelayedStart toggles delayed auto-start per
+// --service-delayed-start so Docker can wait for boot-critical services to
+// settle before SCM starts it.
+func configureServiceDelayedStart(s *mgr.Service) error {
+	var cfg serviceDelayedAutoStartInfo
+	if *flServiceDelayedStart {
+		cfg.IsDelayedAutoStartUp = 1
+	}
+
+	r, _, err := procChangeServiceConfig2.Call(
+		uintptr(s.Handle),
+		uintptr(serviceConfigDelayedAutoStartInfo),
+		uintptr(unsafe.Pointer(&cfg)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// configureServiceDescription sets the description shown by `sc.exe qc`.
+func configureServiceDescription(s *mgr.Service) error {
+	desc, err := syscall.UTF16PtrFromString(serviceDescriptionText)
+	if err != nil {
+		return err
+	}
+
+	cfg := serviceDescription{Description: desc}
+	r, _, err := procChangeServiceConfig2.Call(
+		uintptr(s.Handle),
+		uintptr(serviceConfigDescription),
+		uintptr(unsafe.Pointer(&cfg)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// configureServicePreshutdownTimeout sets how long the SCM will wait after
+// sending SERVICE_CONTROL_PRESHUTDOWN before it kills the process, per
+// --service-preshutdown-timeout.
+func configureServicePreshutdownTimeout(s *mgr.Service) error {
+	cfg := servicePreshutdownInfo{
+		PreshutdownTimeout: uint32(flServicePreshutdownTimeout.Nanoseconds() / int64(time.Millisecond)),
+	}
+
+	r, _, err := procChangeServiceConfig2.Call(
+		uintptr(s.Handle),
+		uintptr(serviceConfigPreshutdownInfo),
+		uintptr(unsafe.Pointer(&cfg)),
+	)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// reconfigureService applies the recovery, delayed-start, description, and
+// preshutdown settings to an already-registered service, so admins can tune
+// them without deleting and recreating the service (which would drop ACLs
+// and dependencies).
+func reconfigureService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(*flServiceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := configureServiceFailureActions(s); err != nil {
+		return err
+	}
+	if err := configureServiceDelayedStart(s); err != nil {
+		return err
+	}
+	if err := configureServiceDescription(s); err != nil {
+		return err
+	}
+	return configureServicePreshutdownTimeout(s)
+}
+
+// lsaUnicodeString mirrors the Win32 LSA_UNICODE_STRING struct.
+type lsaUnicodeString struct {
+	Length        uint16
+	MaximumLength uint16
+	Buffer        *uint16
+}
+
+func newLSAUnicodeString(s string) (lsaUnicodeString, error) {
+	p, err := syscall.UTF16PtrFromString(s)
+	if err != nil {
+		return lsaUnicodeString{}, err
+	}
+	// Length is in bytes, counted over UTF-16 code units, not UTF-8 bytes
+	// of s - the two diverge for any non-ASCII account name.
+	n := uint16(len(utf16.Encode([]rune(s))) * 2)
+	return lsaUnicodeString{Length: n, MaximumLength: n, Buffer: p}, nil
+}
+
+func (s lsaUnicodeString) String() string {
+	if s.Buffer == nil || s.Length == 0 {
+		return ""
+	}
+	return syscall.UTF16ToString((*[1 << 15]uint16)(unsafe.Pointer(s.Buffer))[: s.Length/2 : s.Length/2])
+}
+
+// lsaObjectAttributes mirrors the Win32 LSA_OBJECT_ATTRIBUTES struct.
+type lsaObjectAttributes struct {
+	Length                   uint32
+	RootDirectory            windows.Handle
+	ObjectName               *lsaUnicodeString
+	Attributes               uint32
+	SecurityDescriptor       uintptr
+	SecurityQualityOfService uintptr
+}
+
+// lsaTranslatedSID2 mirrors the Win32 LSA_TRANSLATED_SID2 struct.
+type lsaTranslatedSID2 struct {
+	Use         uint32
+	Sid         uintptr
+	DomainIndex int32
+	Flags       uint32
+}
+
+const (
+	policyLookupNames = 0x00000800
+
+	seServiceLogonRight = "SeServiceLogonRight"
+)
+
+var (
+	procLsaOpenPolicy             = advapi32.NewProc("LsaOpenPolicy")
+	procLsaClose                  = advapi32.NewProc("LsaClose")
+	procLsaNtStatusToWinError     = advapi32.NewProc("LsaNtStatusToWinError")
+	procLsaLookupNames2           = advapi32.NewProc("LsaLookupNames2")
+	procLsaEnumerateAccountRights = advapi32.NewProc("LsaEnumerateAccountRights")
+	procLsaFreeMemory             = advapi32.NewProc("LsaFreeMemory")
+)
+
+func lsaError(status uintptr) error {
+	winErr, _, _ := procLsaNtStatusToWinError.Call(status)
+	return syscall.Errno(winErr)
+}
+
+// validateServiceLogonRight is a best-effort check that account already
+// holds SeServiceLogonRight directly, so a plainly misconfigured
+// --service-account fails fast instead of CreateService succeeding and the
+// SCM rejecting the start much later with an opaque error code. It cannot
+// see rights granted indirectly through group membership, so it only ever
+// errors on problems with the account lookup itself; a right it can't
+// confirm results in a warning, not a failure.
+func validateServiceLogonRight(account string) error {
+	var (
+		oa     lsaObjectAttributes
+		policy windows.Handle
+	)
+	status, _, _ := procLsaOpenPolicy.Call(0, uintptr(unsafe.Pointer(&oa)), uintptr(policyLookupNames), uintptr(unsafe.Pointer(&policy)))
+	if status != 0 {
+		return fmt.Errorf("opening LSA policy: %v", lsaError(status))
+	}
+	defer procLsaClose.Call(uintptr(policy))
+
+	name, err := newLSAUnicodeString(account)
+	if err != nil {
+		return err
+	}
+
+	var domains, sids uintptr
+	status, _, _ = procLsaLookupNames2.Call(
+		uintptr(policy),
+		0,
+		1,
+		uintptr(unsafe.Pointer(&name)),
+		uintptr(unsafe.Pointer(&domains)),
+		uintptr(unsafe.Pointer(&sids)),
+	)
+	if domains != 0 {
+		defer procLsaFreeMemory.Call(domains)
+	}
+	if status != 0 {
+		return fmt.Errorf("looking up account %q: %v", account, lsaError(status))
+	}
+	defer procLsaFreeMemory.Call(sids)
+
+	sid := (*lsaTranslatedSID2)(unsafe.Pointer(sids))
+
+	// LsaEnumerateAccountRights only reports rights assigned directly to
+	// this SID. A gMSA or domain account commonly gets SeServiceLogonRight
+	// through membership in a security group configured via Group Policy,
+	// which this call can't see (and typically fails to enumerate at all,
+	// e.g. with STATUS_OBJECT_NAME_NOT_FOUND, for an account with no
+	// directly-assigned rights). So this check can only confirm the right
+	// when it's assigned directly; it can't prove its absence.
+	var rights uintptr
+	var rightsCount uint32
+	status, _, _ = procLsaEnumerateAccountRights.Call(
+		uintptr(policy),
+		sid.Sid,
+		uintptr(unsafe.Pointer(&rights)),
+		uintptr(unsafe.Pointer(&rightsCount)),
+	)
+	if status != 0 {
+		logrus.Warnf("could not enumerate logon rights for %q (%v); if %s is granted via group membership this can't be verified here, proceeding anyway", account, lsaError(status), seServiceLogonRight)
+		return nil
+	}
+	defer procLsaFreeMemory.Call(rights)
+
+	entries := (*[1 << 10]lsaUnicodeString)(unsafe.Pointer(rights))[:rightsCount:rightsCount]
+	for _, r := range entries {
+		if r.String() == seServiceLogonRight {
+			return nil
+		}
+	}
+
+	logrus.Warnf("account %q does not have %s assigned directly; if it's granted via group membership this can't be verified here, proceeding anyway", account, seServiceLogonRight)
+	return nil
+}
+
 func registerService() error {
 	p, err := getServicePath()
 	if err != nil {
 		return err
 	}
+
+	if *flServiceAccount != "" {
+		if err := validateServiceLogonRight(*flServiceAccount); err != nil {
+			return err
+		}
+	}
+
 	m, err := mgr.Connect()
 	if err != nil {
 		return err
 	}
 	defer m.Disconnect()
 	c := mgr.Config{
-		ServiceType:  windows.SERVICE_WIN32_OWN_PROCESS,
-		StartType:    mgr.StartAutomatic,
-		ErrorControl: mgr.ErrorNormal,
-		DisplayName:  "Docker Engine",
+		ServiceType:      windows.SERVICE_WIN32_OWN_PROCESS,
+		StartType:        mgr.StartAutomatic,
+		ErrorControl:     mgr.ErrorNormal,
+		DisplayName:      "Docker Engine",
+		Dependencies:     flServiceDependsOn.GetAll(),
+		ServiceStartName: *flServiceAccount,
+		Password:         *flServicePassword,
 	}
 
 	// Configure the service to launch with the arguments that were just passed.
@@ -179,6 +821,19 @@ func registerService() error {
 		return err
 	}
 
+	if err := configureServiceFailureActions(s); err != nil {
+		return err
+	}
+	if err := configureServiceDelayedStart(s); err != nil {
+		return err
+	}
+	if err := configureServiceDescription(s); err != nil {
+		return err
+	}
+	if err := configureServicePreshutdownTimeout(s); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -215,6 +870,10 @@ func initService() (bool, error) {
 		return true, registerService()
 	}
 
+	if *flReconfigureService {
+		return true, reconfigureService()
+	}
+
 	if !*flRunService {
 		return false, nil
 	}
@@ -237,7 +896,15 @@ func initService() (bool, error) {
 		}
 	}
 
-	logrus.AddHook(&etwHook{log})
+	if *flLogFile != "" {
+		fileHook, err := newRotatingFileHook(*flLogFile, *flLogFileMaxSize, *flLogFileMaxFiles)
+		if err != nil {
+			return false, err
+		}
+		logrus.AddHook(fileHook)
+	}
+
+	logrus.AddHook(&etwHook{log: log, onlyHighSeverity: *flLogFile != ""})
 	logrus.SetOutput(ioutil.Discard)
 
 	service = h
@@ -247,6 +914,9 @@ func initService() (bool, error) {
 		} else {
 			err = svc.Run(*flServiceName, h)
 		}
+		if err != nil {
+			logServiceDependencyDiagnostics(*flServiceName)
+		}
 
 		h.fromsvc <- err
 	}()
@@ -261,7 +931,14 @@ func initService() (bool, error) {
 
 func (h *handler) started() error {
 	// This must be delayed until daemonCli initializes Config.Root
-	err := initPanicFile(filepath.Join(daemonCli.Config.Root, "panic.log"))
+	panicFilePath := filepath.Join(daemonCli.Config.Root, "panic.log")
+	if *flLogFile != "" {
+		// Keep the panic file next to the chosen log file rather than
+		// buried in the daemon root.
+		panicFilePath = filepath.Join(filepath.Dir(*flLogFile), "panic.log")
+	}
+
+	err := initPanicFile(panicFilePath)
 	if err != nil {
 		return err
 	}
@@ -285,22 +962,56 @@ func (h *handler) Execute(_ []string, r <-chan svc.ChangeRequest, s chan<- svc.S
 	failed := <-h.tosvc
 	if failed {
 		logrus.Debugf("Aborting service start due to failure during initializtion")
+		logServiceDependencyDiagnostics(*flServiceName)
 		return true, 1
 	}
 
-	s <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown | svc.Accepted(windows.SERVICE_ACCEPT_PARAMCHANGE)}
+	accepts := svc.AcceptStop | svc.AcceptShutdown | svc.Accepted(windows.SERVICE_ACCEPT_PARAMCHANGE) | svc.Accepted(windows.SERVICE_ACCEPT_PRESHUTDOWN)
+	s <- svc.Status{State: svc.Running, Accepts: accepts}
 	logrus.Debugf("Service running")
+
+	// preshutdownTickerC and preshutdownDeadline are only set once a
+	// SERVICE_CONTROL_PRESHUTDOWN notification arrives, to keep the SCM
+	// informed while daemonCli.stop() drains containers. A nil channel in
+	// a select blocks forever, so they're safe to read before that.
+	var (
+		preshutdownTicker     *time.Ticker
+		preshutdownTickerC    <-chan time.Time
+		preshutdownDeadline   <-chan time.Time
+		preshutdownCheckpoint uint32
+	)
+	defer func() {
+		if preshutdownTicker != nil {
+			preshutdownTicker.Stop()
+		}
+	}()
+
 Loop:
 	for {
 		select {
 		case failed = <-h.tosvc:
 			break Loop
+		case <-preshutdownTickerC:
+			preshutdownCheckpoint++
+			s <- svc.Status{State: svc.StopPending, WaitHint: preshutdownWaitHintMillis, CheckPoint: preshutdownCheckpoint}
+		case <-preshutdownDeadline:
+			logrus.Warnf("Preshutdown drain did not finish within %s; proceeding with shutdown", *flServicePreshutdownTimeout)
+			break Loop
 		case c := <-r:
 			switch c.Cmd {
 			case svc.Cmd(windows.SERVICE_CONTROL_PARAMCHANGE):
 				daemonCli.reloadConfig()
 			case svc.Interrogate:
 				s <- c.CurrentStatus
+			case svc.Cmd(windows.SERVICE_CONTROL_PRESHUTDOWN):
+				logrus.Debugf("Received preshutdown notification; draining for up to %s", *flServicePreshutdownTimeout)
+				s <- svc.Status{State: svc.StopPending, WaitHint: preshutdownWaitHintMillis, CheckPoint: preshutdownCheckpoint}
+
+				preshutdownTicker = time.NewTicker(preshutdownCheckpointInterval)
+				preshutdownTickerC = preshutdownTicker.C
+				preshutdownDeadline = time.After(*flServicePreshutdownTimeout)
+
+				go daemonCli.stop()
 			case svc.Stop, svc.Shutdown:
 				s <- svc.Status{State: svc.StopPending, Accepts: 0}
 				daemonCli.stop()